@@ -3,260 +3,143 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"go/ast"
 	"go/build"
-	"go/format"
-	"go/parser"
-	"go/token"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 
-	"golang.org/x/tools/go/buildutil"
-	"golang.org/x/tools/go/loader"
-	"golang.org/x/tools/go/types"
-	"golang.org/x/tools/refactor/importgraph"
+	"github.com/fatih/unexport/unexport"
 )
 
 func main() {
 	var (
-		flagPackage    = flag.String("package", "", "package import path to be unexported")
 		flagIdentifier = flag.String("identifier", "", "comma-separated list of identifiers names; if empty all identifiers are unexported")
 		flagDryRun     = flag.Bool("dryrun", false, "show the change, but do not apply")
 		flagVerbose    = flag.Bool("verbose", false, "show more information. Useful for debugging.")
+		flagTags       = flag.String("tags", "", "a list of build tags to consider satisfied during the build")
+		flagMod        = flag.String("mod", "", "module download mode to pass to the go command (readonly, vendor, or mod)")
+		flagOverlay    = flag.String("overlay", "", "JSON file of the form {\"Replace\": {path: contents}} describing unsaved buffers to use instead of the files on disk")
+		flagRevert     = flag.Bool("revert", false, "revert identifiers previously unexported, using the rewrite logs left next to each package")
+		flagForce      = flag.Bool("force", false, "unexport methods even if they look load-bearing for an interface or their receiver is used as a field type in another package")
 	)
 
-	flag.Var((*buildutil.TagsFlag)(&build.Default.BuildTags), "tags", buildutil.TagsFlagDoc)
-
+	flag.Usage = Usage
 	flag.Parse()
 	log.SetPrefix("unexport:")
 
-	if err := runMain(&config{
-		importPath:   *flagPackage,
-		identifiers:  strings.Split(*flagIdentifier, ","),
-		buildContext: &build.Default,
-		dryRun:       *flagDryRun,
-		verbose:      *flagVerbose,
-	}); err != nil {
-		fmt.Fprintf(os.Stderr, "unexport: %s\n", err)
-		os.Exit(1)
-	}
-}
-
-// config is used to define how unexport should be work
-type config struct {
-	// importPath defines the package defined with the importpath
-	importPath string
-
-	// identifiers is used to limit the changes of unexporting to certain identifiers
-	identifiers []string
-
-	// build context
-	buildContext *build.Context
-
-	// logging/development ...
-	dryRun  bool
-	verbose bool
-}
-
-// runMain runs the actual command. It's an helper function so we can easily
-// calls defers or return errors.
-func runMain(conf *config) error {
-	if conf.importPath == "" {
-		return errors.New("import path of the package must be given")
+	patterns := flag.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
 	}
 
-	path := conf.importPath
-
-	prog, err := loadProgram(conf.buildContext, map[string]bool{path: true})
-	if err != nil {
-		return err
+	ctxt := build.Default
+	if *flagTags != "" {
+		ctxt.BuildTags = strings.Split(*flagTags, ",")
 	}
 
-	_, rev, errors := importgraph.Build(conf.buildContext)
-	if len(errors) > 0 {
-		// With a large GOPATH tree, errors are inevitable.
-		// Report them but proceed.
-		fmt.Fprintf(os.Stderr, "While scanning Go workspace:\n")
-		for path, err := range errors {
-			fmt.Fprintf(os.Stderr, "Package %q: %s.\n", path, err)
+	if *flagRevert {
+		u := &unexport.Unexporter{Ctxt: &ctxt, Mod: *flagMod, Patterns: patterns}
+		if err := u.Revert(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "unexport: %s\n", err)
+			os.Exit(1)
 		}
+		return
 	}
 
-	// Enumerate the set of potentially affected packages.
-	possiblePackages := make(map[string]bool)
-	for _, obj := range findExportedObjects(prog, path) {
-		// External test packages are never imported,
-		// so they will never appear in the graph.
-		for path := range rev.Search(obj.Pkg().Path()) {
-			possiblePackages[path] = true
-		}
+	overlay, err := readOverlay(*flagOverlay)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unexport: %s\n", err)
+		os.Exit(1)
 	}
 
-	if conf.verbose {
-		fmt.Println("Possible affected packages:")
-		for pkg := range possiblePackages {
-			fmt.Println("\t", pkg)
-		}
+	var identifiers []string
+	if *flagIdentifier != "" {
+		identifiers = strings.Split(*flagIdentifier, ",")
 	}
 
-	// reload the program with all possible packages to fetch the packageinfo's
-	globalProg, err := loadProgram(conf.buildContext, possiblePackages)
-	if err != nil {
-		return err
+	u := &unexport.Unexporter{
+		Ctxt:        &ctxt,
+		Mod:         *flagMod,
+		Patterns:    patterns,
+		Identifiers: identifiers,
+		DryRun:      *flagDryRun,
+		Overlay:     overlay,
+		Force:       *flagForce,
 	}
 
-	objsToUpdate := make(map[types.Object]bool, 0)
-	objects := findExportedObjects(globalProg, path)
-
-	if conf.verbose {
-		log.Println("Exported identififers are:")
-		for _, obj := range objects {
-			log.Println("\t", obj)
-		}
+	if err := run(u, *flagVerbose); err != nil {
+		fmt.Fprintf(os.Stderr, "unexport: %s\n", err)
+		os.Exit(1)
 	}
+}
 
-	for _, info := range globalProg.Imported {
-		safeObjects := filterObjects(info, objects)
-		for _, obj := range safeObjects {
-			objsToUpdate[obj] = true
-		}
+// readOverlay reads the {"Replace": {path: contents}} overlay file named by
+// path, the same schema gopls and goimports accept. It returns a nil map if
+// path is empty.
+func readOverlay(path string) (map[string][]byte, error) {
+	if path == "" {
+		return nil, nil
 	}
 
-	if conf.verbose {
-		log.Println("Safe to unexport identifiers are:")
-		for obj := range objsToUpdate {
-			log.Println("\t", obj)
-		}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	var nidents int
-	var filesToUpdate = make(map[*token.File]bool)
-	for _, info := range globalProg.Imported {
-		for id, obj := range info.Defs {
-			if objsToUpdate[obj] {
-				nidents++
-				id.Name = strings.ToLower(obj.Name())
-				filesToUpdate[globalProg.Fset.File(id.Pos())] = true
-			}
-		}
-		for id, obj := range info.Uses {
-			if objsToUpdate[obj] {
-				nidents++
-				id.Name = strings.ToLower(obj.Name())
-				filesToUpdate[globalProg.Fset.File(id.Pos())] = true
-			}
-		}
+	var contents struct {
+		Replace map[string]string
 	}
-
-	var nerrs, npkgs int
-	for _, info := range globalProg.Imported {
-		first := true
-		for _, f := range info.Files {
-			tokenFile := globalProg.Fset.File(f.Pos())
-			if filesToUpdate[tokenFile] {
-				if first {
-					npkgs++
-					first = false
-				}
-				if err := rewriteFile(globalProg.Fset, f, tokenFile.Name()); err != nil {
-					log.Println(err)
-					nerrs++
-				}
-			}
-		}
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("invalid overlay file %s: %v", path, err)
 	}
 
-	log.Printf("Unexported %d occurrence%s in %d file%s in %d package%s.\n", nidents, plural(nidents),
-		len(filesToUpdate), plural(len(filesToUpdate)),
-		npkgs, plural(npkgs))
-	if nerrs > 0 {
-		return fmt.Errorf("failed to rewrite %d file%s", nerrs, plural(nerrs))
+	overlay := make(map[string][]byte, len(contents.Replace))
+	for name, text := range contents.Replace {
+		overlay[name] = []byte(text)
 	}
-
-	return nil
+	return overlay, nil
 }
 
-func plural(n int) string {
-	if n != 1 {
-		return "s"
-	}
-	return ""
+// Usage is a replacement usage function for the flag package.
+func Usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tunexport [flags] [packages]\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
 }
 
-func rewriteFile(fset *token.FileSet, f *ast.File, filename string) error {
-	var buf bytes.Buffer
-	if err := format.Node(&buf, fset, f); err != nil {
-		return fmt.Errorf("failed to pretty-print syntax tree: %v", err)
+// run drives u through the Load/Plan/Apply sequence.
+func run(u *unexport.Unexporter, verbose bool) error {
+	if err := u.Load(); err != nil {
+		return err
 	}
-	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
-}
 
-// filterObjects filters the given objects and returns objects which are not in use by the given info package
-func filterObjects(info *loader.PackageInfo, exported map[*ast.Ident]types.Object) map[*ast.Ident]types.Object {
-	filtered := make(map[*ast.Ident]types.Object, 0)
-	for id, ex := range exported {
-		if !hasUse(info, ex) {
-			filtered[id] = ex
-		}
+	renames, err := u.Plan()
+	if err != nil {
+		return err
 	}
 
-	return filtered
-}
-
-// hasUse returns true if the given obj is part of the use in info
-func hasUse(info *loader.PackageInfo, obj types.Object) bool {
-	for _, o := range info.Uses {
-		if o == obj {
-			return true
-		}
+	for _, s := range u.Skipped() {
+		log.Printf("skipping %s.%s (%s): %s\n", s.Pkg, s.Name, s.Pos, s.Reason)
 	}
-	return false
-}
 
-// exportedObjects returns objects which are exported only
-func exportedObjects(info *loader.PackageInfo) map[*ast.Ident]types.Object {
-	objects := make(map[*ast.Ident]types.Object, 0)
-	for id, obj := range info.Defs {
-		if obj == nil {
-			continue
-		}
-
-		if obj.Exported() {
-			objects[id] = obj
+	if verbose {
+		log.Println("Safe to unexport identifiers are:")
+		for _, r := range renames {
+			log.Printf("\t%s.%s -> %s (%s)\n", r.Pkg, r.OldName, r.NewName, r.Pos)
 		}
-	}
 
-	return objects
-}
-
-func findExportedObjects(prog *loader.Program, path string) map[*ast.Ident]types.Object {
-	var pkgObj *types.Package
-	for pkg := range prog.AllPackages {
-		if pkg.Path() == path {
-			pkgObj = pkg
-			break
+		stats := u.Stats()
+		cache := "miss"
+		if stats.ImportGraphCacheHit {
+			cache = "hit"
 		}
+		log.Printf("import graph cache: %s, load took %s, plan took %s\n", cache, stats.LoadDuration, stats.PlanDuration)
 	}
 
-	info := prog.AllPackages[pkgObj]
-	return exportedObjects(info)
-}
-
-func loadProgram(ctxt *build.Context, pkgs map[string]bool) (*loader.Program, error) {
-	conf := loader.Config{
-		Build:       ctxt,
-		ParserMode:  parser.ParseComments,
-		AllowErrors: false,
-	}
-
-	for pkg := range pkgs {
-		conf.ImportWithTests(pkg)
-	}
-	return conf.Load()
+	return u.Apply(os.Stdout)
 }
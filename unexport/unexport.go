@@ -0,0 +1,1238 @@
+// Package unexport implements the logic behind the unexport command: it
+// finds exported identifiers in a selected set of packages that are not
+// referenced by any package other than the one that declares them, and
+// renames them to their unexported form.
+package unexport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kisielk/gotool"
+	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/tools/go/packages"
+)
+
+// rewriteLogName is the name of the JSON rewrite log Apply writes next to
+// each rewritten package, and that Revert reads back.
+const rewriteLogName = ".unexport-rewrite.json"
+
+// Rename describes a single identifier that Plan has decided is safe to
+// unexport.
+type Rename struct {
+	Pkg     string
+	OldName string
+	NewName string
+	Pos     token.Position
+}
+
+// Unexporter unexports identifiers declared in the packages matched by
+// Patterns which are not referenced by any package other than the one that
+// declares them. Callers must call Load, then Plan, then Apply, in that
+// order.
+type Unexporter struct {
+	// Ctxt is the build context used to resolve build tags. Defaults to
+	// build.Default if nil.
+	Ctxt *build.Context
+
+	// Mod sets the -mod flag (e.g. "readonly", "vendor", "mod") passed to
+	// the go command while loading packages. Empty leaves the go command's
+	// own default in effect.
+	Mod string
+
+	// Patterns holds the package patterns to refactor, e.g. "./..." or a
+	// list of import paths. An identifier is only safe to unexport if every
+	// use of it lives in the one package that defines it; a use from any
+	// other package - even a sibling matched by Patterns - disqualifies
+	// it, since Go forbids referencing an unexported name across a package
+	// boundary.
+	Patterns []string
+
+	// Identifiers limits the rename to these identifier names; if empty all
+	// exported identifiers are considered.
+	Identifiers []string
+
+	// DryRun, when true, makes Apply report the change without writing it
+	// to disk.
+	DryRun bool
+
+	// Overlay maps absolute file paths to their in-memory contents, using
+	// the same schema gopls and goimports accept
+	// ({"Replace": {"/abs/path.go": "..."}}). When set, Load type-checks
+	// against these buffers instead of the files on disk, and Apply writes
+	// the rewritten buffers back into this map and prints the updated
+	// mapping as JSON to its writer instead of touching disk.
+	Overlay map[string][]byte
+
+	// Force skips the interface-satisfaction and field-usage safety checks
+	// Plan otherwise applies to exported methods.
+	Force bool
+
+	// CacheDir overrides where Load caches the reverse import graph between
+	// invocations, keyed by a hash of the workspace it was built from.
+	// Defaults to os.UserCacheDir()'s "unexport" subdirectory if empty; set
+	// it to "-" to disable caching.
+	CacheDir string
+
+	buildFlags []string
+	rev        map[string]map[string]bool
+	targets    []*packages.Package
+	global     []*packages.Package
+	toUpdate   map[types.Object]bool
+	skipped    []SkippedRename
+	stats      Stats
+}
+
+// Stats records timing and cache information from the last Load and Plan
+// calls, for callers that want to report it (e.g. behind -verbose).
+type Stats struct {
+	// ImportGraphCacheHit reports whether Load reused a cached reverse
+	// import graph instead of rebuilding it from scratch.
+	ImportGraphCacheHit bool
+
+	// LoadDuration is how long the last call to Load took.
+	LoadDuration time.Duration
+
+	// PlanDuration is how long the last call to Plan took.
+	PlanDuration time.Duration
+}
+
+// Stats returns timing and cache information from the last Load and Plan
+// calls.
+func (u *Unexporter) Stats() Stats {
+	return u.stats
+}
+
+// SkippedRename describes an exported method Plan left alone because
+// unexporting it looked unsafe, along with why.
+type SkippedRename struct {
+	Pkg    string
+	Name   string
+	Pos    token.Position
+	Reason string
+}
+
+// buildFlagsFor returns the -tags and -mod flags to pass to the go command
+// while loading packages, given ctxt and Mod.
+func (u *Unexporter) buildFlagsFor(ctxt *build.Context) []string {
+	var buildFlags []string
+	if len(ctxt.BuildTags) > 0 {
+		buildFlags = append(buildFlags, "-tags", strings.Join(ctxt.BuildTags, ","))
+	}
+	if u.Mod != "" {
+		buildFlags = append(buildFlags, "-mod", u.Mod)
+	}
+	return buildFlags
+}
+
+// Load resolves Patterns and builds the reverse import graph needed by
+// Plan. It must be called before Plan.
+func (u *Unexporter) Load() error {
+	start := time.Now()
+
+	ctxt := u.Ctxt
+	if ctxt == nil {
+		ctxt = &build.Default
+	}
+
+	buildFlags := u.buildFlagsFor(ctxt)
+
+	patterns := gotool.ImportPaths(u.Patterns)
+
+	// The reverse import graph must cover the whole workspace, not just the
+	// target patterns: a package that imports a target can live anywhere,
+	// and packages.Load only walks imports forwards, so only packages
+	// reachable as dependencies of the graph's own roots ever show up as
+	// importers. Loading "./..." instead of patterns makes sure every
+	// potential importer is a root.
+	rev, cacheHit, err := u.loadImportGraphCached([]string{"./..."}, buildFlags)
+	if err != nil {
+		return err
+	}
+
+	targets, err := loadPackages(patterns, buildFlags, u.Overlay)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no packages matched by %s", strings.Join(u.Patterns, " "))
+	}
+
+	u.buildFlags = buildFlags
+	u.rev = rev
+	u.targets = targets
+	u.stats.ImportGraphCacheHit = cacheHit
+	u.stats.LoadDuration = time.Since(start)
+	return nil
+}
+
+// loadImportGraphCached is loadImportGraph, but reuses a reverse import
+// graph previously cached to disk by cacheDir when the workspace (as
+// identified by patterns, buildFlags and the current directory) has not
+// changed since. It reports whether the cache was used.
+func (u *Unexporter) loadImportGraphCached(patterns, buildFlags []string) (map[string]map[string]bool, bool, error) {
+	if u.CacheDir == "-" {
+		rev, err := loadImportGraph(patterns, buildFlags, u.Overlay)
+		return rev, false, err
+	}
+
+	fingerprint := workspaceFingerprint()
+
+	var cachePath string
+	if dir := u.cacheDir(); dir != "" {
+		cachePath = filepath.Join(dir, workspaceKey(patterns, buildFlags)+".json")
+		if rev, ok := readImportGraphCache(cachePath, fingerprint); ok {
+			return rev, true, nil
+		}
+	}
+
+	rev, err := loadImportGraph(patterns, buildFlags, u.Overlay)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if cachePath != "" {
+		writeImportGraphCache(cachePath, fingerprint, rev)
+	}
+
+	return rev, false, nil
+}
+
+// cacheDir returns the directory Load caches the reverse import graph in,
+// or "" if no usable cache directory is available.
+func (u *Unexporter) cacheDir() string {
+	if u.CacheDir != "" {
+		return u.CacheDir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "unexport")
+}
+
+// workspaceKey hashes the inputs that determine an import graph's contents,
+// so that a stale or unrelated workspace never shares a cache entry.
+func workspaceKey(patterns, buildFlags []string) string {
+	h := sha256.New()
+	for _, p := range patterns {
+		io.WriteString(h, p)
+		h.Write([]byte{0})
+	}
+	for _, f := range buildFlags {
+		io.WriteString(h, f)
+		h.Write([]byte{0})
+	}
+	if wd, err := os.Getwd(); err == nil {
+		io.WriteString(h, wd)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// importGraphCache is the on-disk representation written by
+// writeImportGraphCache: the reverse import graph plus the workspace
+// fingerprint it was computed from, so a later run can tell whether any
+// source file has since been added, removed or edited.
+type importGraphCache struct {
+	Fingerprint string                     `json:"fingerprint"`
+	Graph       map[string]map[string]bool `json:"graph"`
+}
+
+// workspaceFingerprint hashes the path and content of every .go file under
+// the current directory. Unlike a go.mod timestamp, this changes whenever
+// an import is added to or removed from any source file, which is exactly
+// what would otherwise make a cached reverse import graph go stale.
+func workspaceFingerprint() string {
+	root, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+
+	var paths []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".go") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, path := range paths {
+		io.WriteString(h, path)
+		h.Write([]byte{0})
+		if f, err := os.Open(path); err == nil {
+			io.Copy(h, f)
+			f.Close()
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readImportGraphCache reads back a reverse import graph written by
+// writeImportGraphCache, refusing it unless the workspace fingerprint
+// matches the one it was cached under.
+func readImportGraphCache(path, fingerprint string) (map[string]map[string]bool, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var cached importGraphCache
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, false
+	}
+	if cached.Fingerprint == "" || cached.Fingerprint != fingerprint {
+		return nil, false
+	}
+	return cached.Graph, true
+}
+
+// writeImportGraphCache persists rev and fingerprint to path for
+// readImportGraphCache to pick up on a later invocation. Failures are not
+// fatal: the cache is a pure optimization.
+func writeImportGraphCache(path, fingerprint string, rev map[string]map[string]bool) {
+	data, err := json.Marshal(importGraphCache{Fingerprint: fingerprint, Graph: rev})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	_ = ioutil.WriteFile(path, data, 0644)
+}
+
+// Plan reports the identifiers that are safe to unexport, without modifying
+// any files. Load must be called first.
+func (u *Unexporter) Plan() ([]Rename, error) {
+	start := time.Now()
+	defer func() { u.stats.PlanDuration = time.Since(start) }()
+
+	if u.targets == nil {
+		return nil, errors.New("unexport: Load must be called before Plan")
+	}
+
+	targetPaths := make(map[string]bool, len(u.targets))
+	for _, pkg := range u.targets {
+		targetPaths[pkg.PkgPath] = true
+	}
+
+	// Enumerate the set of potentially affected packages.
+	possiblePackages := make(map[string]bool, len(targetPaths))
+	for path := range targetPaths {
+		possiblePackages[path] = true
+	}
+	for _, pkg := range u.targets {
+		for _, obj := range exportedObjects(pkg) {
+			for importer := range reverseClosure(u.rev, obj.Pkg().Path()) {
+				possiblePackages[importer] = true
+			}
+		}
+	}
+
+	var loadPatterns []string
+	for pkg := range possiblePackages {
+		loadPatterns = append(loadPatterns, pkg)
+	}
+
+	// reload the packages with all possible packages to fetch the type info
+	global, err := loadPackages(loadPatterns, u.buildFlags, u.Overlay)
+	if err != nil {
+		return nil, err
+	}
+	u.global = global
+
+	objects := make(map[*ast.Ident]types.Object)
+	for _, pkg := range global {
+		if !targetPaths[pkg.PkgPath] {
+			continue
+		}
+		for id, obj := range exportedObjects(pkg) {
+			if !u.wanted(obj.Name()) {
+				continue
+			}
+			objects[id] = obj
+		}
+	}
+
+	// A package with _test.go files is type-checked more than once by
+	// packages.Load (Tests is always set): once for the package itself and
+	// again for its "[pkg.test]" and external test variants. Each variant
+	// gets its own, pointer-distinct types.Object for the very same
+	// declaration, so a use visible only through one variant's object would
+	// otherwise go unnoticed. Group every object by its declaration
+	// position so the safety check and the rename below treat all of a
+	// declaration's variants as one.
+	fset := fsetOf(global)
+	groups := groupObjectsByPosition(global)
+
+	// An identifier is safe to unexport only if every use of it lives in the
+	// one package that defines it: Go forbids referencing an unexported
+	// name from any other package, whether or not that package is also
+	// under refactor, so a use from a sibling package in the selection
+	// disqualifies it just as an external use would. Scan every loaded
+	// package for uses with a worker pool: on a large reverse closure this
+	// loop dominates Plan.
+	toUpdate := make(map[types.Object]bool, len(objects))
+	for _, obj := range objects {
+		for _, v := range groups[canonicalKey(fset, obj)] {
+			toUpdate[v] = true
+		}
+	}
+	for obj := range externallyUsed(global, toUpdate) {
+		for _, v := range groups[canonicalKey(fset, obj)] {
+			delete(toUpdate, v)
+		}
+	}
+
+	// A method may be load-bearing even with no direct external use: it can
+	// be required to satisfy an interface reachable from the loaded packages
+	// (including the standard library and the predeclared error), or its
+	// receiver type may be used as a field type in another package. Skip
+	// those unless Force is set.
+	u.skipped = nil
+	if !u.Force {
+		ifaces := collectInterfaces(global)
+		for _, pkg := range global {
+			for id, obj := range pkg.TypesInfo.Defs {
+				if !toUpdate[obj] {
+					continue
+				}
+				fn, sig, ok := methodSignature(obj)
+				if !ok {
+					continue
+				}
+				reason := methodSkipReason(fn, sig, ifaces, global)
+				if reason == "" {
+					continue
+				}
+				for _, v := range groups[canonicalKey(fset, obj)] {
+					delete(toUpdate, v)
+				}
+				u.skipped = append(u.skipped, SkippedRename{
+					Pkg:    pkg.PkgPath,
+					Name:   fn.Name(),
+					Pos:    fset.Position(id.Pos()),
+					Reason: reason,
+				})
+			}
+		}
+	}
+	u.toUpdate = toUpdate
+
+	// Each grouped declaration can appear more than once above - once per
+	// package variant - so dedupe by position before reporting it.
+	var renames []Rename
+	seen := make(map[string]bool)
+	for _, pkg := range global {
+		for id, obj := range pkg.TypesInfo.Defs {
+			if !toUpdate[obj] {
+				continue
+			}
+			key := canonicalKey(pkg.Fset, obj)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			renames = append(renames, Rename{
+				Pkg:     pkg.PkgPath,
+				OldName: obj.Name(),
+				NewName: strings.ToLower(obj.Name()),
+				Pos:     pkg.Fset.Position(id.Pos()),
+			})
+		}
+	}
+
+	return renames, nil
+}
+
+// Skipped reports the exported methods the last call to Plan left alone
+// because unexporting them looked unsafe. It is empty when Force is set.
+func (u *Unexporter) Skipped() []SkippedRename {
+	return u.skipped
+}
+
+// methodSignature reports whether obj is a method (a function with a
+// receiver) and, if so, returns it and its signature.
+func methodSignature(obj types.Object) (*types.Func, *types.Signature, bool) {
+	fn, ok := obj.(*types.Func)
+	if !ok {
+		return nil, nil, false
+	}
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return nil, nil, false
+	}
+	return fn, sig, true
+}
+
+// methodSkipReason reports why fn is unsafe to unexport, or "" if it looks
+// safe.
+func methodSkipReason(fn *types.Func, sig *types.Signature, ifaces []*types.Interface, global []*packages.Package) string {
+	named := namedReceiver(sig.Recv().Type())
+	if named == nil {
+		return ""
+	}
+
+	ptr := types.NewPointer(named)
+	for _, iface := range ifaces {
+		if !interfaceRequires(iface, fn.Name()) {
+			continue
+		}
+		if types.Implements(named, iface) || types.Implements(ptr, iface) {
+			return fmt.Sprintf("receiver %s implements interface %s, which declares this method", named.Obj().Name(), iface.String())
+		}
+	}
+
+	if receiverUsedAsFieldElsewhere(named, global) {
+		return fmt.Sprintf("receiver %s is used as a field type outside its own package", named.Obj().Name())
+	}
+
+	return ""
+}
+
+// namedReceiver unwraps a (possibly pointer) receiver type down to its
+// named type, or nil if it isn't one.
+func namedReceiver(t types.Type) *types.Named {
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, _ := t.(*types.Named)
+	return named
+}
+
+// interfaceRequires reports whether iface declares a method named name.
+func interfaceRequires(iface *types.Interface, name string) bool {
+	for i := 0; i < iface.NumMethods(); i++ {
+		if iface.Method(i).Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// collectInterfaces returns every non-empty interface type reachable from
+// global: the predeclared error interface, and every interface declared in
+// global's packages or anything they import, transitively - including the
+// standard library and other dependencies. A method satisfying one of
+// these (fmt.Stringer, sort.Interface, error, ...) is load-bearing even if
+// nothing in global itself declares or implements the interface.
+func collectInterfaces(global []*packages.Package) []*types.Interface {
+	var ifaces []*types.Interface
+	seen := make(map[*types.Interface]bool)
+	add := func(iface *types.Interface) {
+		if iface == nil || iface.NumMethods() == 0 || seen[iface] {
+			return
+		}
+		seen[iface] = true
+		ifaces = append(ifaces, iface)
+	}
+
+	if errType := types.Universe.Lookup("error"); errType != nil {
+		if iface, ok := errType.Type().Underlying().(*types.Interface); ok {
+			add(iface)
+		}
+	}
+
+	visited := make(map[*packages.Package]bool)
+	var visit func(pkg *packages.Package)
+	visit = func(pkg *packages.Package) {
+		if visited[pkg] || pkg.Types == nil {
+			return
+		}
+		visited[pkg] = true
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			tn, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			iface, _ := tn.Type().Underlying().(*types.Interface)
+			add(iface)
+		}
+		for _, imp := range pkg.Imports {
+			visit(imp)
+		}
+	}
+	for _, pkg := range global {
+		visit(pkg)
+	}
+	return ifaces
+}
+
+// receiverUsedAsFieldElsewhere reports whether named is used as the type of
+// a struct field - directly, through a pointer, or as the element or key
+// type of a slice, array, map or channel field - in a package other than
+// the one that declares it.
+func receiverUsedAsFieldElsewhere(named *types.Named, global []*packages.Package) bool {
+	home := named.Obj().Pkg()
+	for _, pkg := range global {
+		if home != nil && pkg.PkgPath == home.Path() {
+			continue
+		}
+		for _, obj := range pkg.TypesInfo.Defs {
+			v, ok := obj.(*types.Var)
+			if !ok || !v.IsField() {
+				continue
+			}
+			if namesType(v.Type(), named) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// namesType reports whether t refers to named, either directly, through a
+// pointer, or as the element or key type of a slice, array, map or
+// channel.
+func namesType(t types.Type, named *types.Named) bool {
+	switch t := t.(type) {
+	case *types.Pointer:
+		return namesType(t.Elem(), named)
+	case *types.Slice:
+		return namesType(t.Elem(), named)
+	case *types.Array:
+		return namesType(t.Elem(), named)
+	case *types.Chan:
+		return namesType(t.Elem(), named)
+	case *types.Map:
+		return namesType(t.Key(), named) || namesType(t.Elem(), named)
+	case *types.Named:
+		return t == named
+	default:
+		return false
+	}
+}
+
+// fsetOf returns the token.FileSet shared by global's packages.
+func fsetOf(global []*packages.Package) *token.FileSet {
+	for _, pkg := range global {
+		return pkg.Fset
+	}
+	return token.NewFileSet()
+}
+
+// wanted reports whether name should be considered for unexporting, given
+// Identifiers.
+func (u *Unexporter) wanted(name string) bool {
+	if len(u.Identifiers) == 0 {
+		return true
+	}
+	for _, id := range u.Identifiers {
+		if id == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteOccurrence records a single renamed identifier, ready to be turned
+// into a RewriteLogEntry once its file name is known.
+type rewriteOccurrence struct {
+	offset    int
+	oldName   string
+	newName   string
+	referrers []string
+}
+
+// RewriteLogEntry records enough information about a single renamed
+// identifier occurrence to mechanically revert it later: which file and
+// byte offset it lives at, its name before and after the rewrite, and the
+// packages that referenced it.
+type RewriteLogEntry struct {
+	File                string   `json:"file"`
+	Offset              int      `json:"offset"`
+	OldName             string   `json:"oldName"`
+	NewName             string   `json:"newName"`
+	ReferencingPackages []string `json:"referencingPackages"`
+}
+
+// Apply renames the identifiers chosen by Plan. Plan must be called first.
+//
+// Apply never reformats a file: unexporting only ever changes an
+// identifier's letter case, never its length, so every renamed occurrence
+// is spliced into the original bytes in place at its recorded offset,
+// leaving the rest of the file untouched. This keeps the diff minimal and
+// guarantees the offsets recorded in the rewrite log always match the
+// bytes actually written, so Revert can undo them byte-exactly regardless
+// of whether the file was gofmt-clean to begin with.
+//
+// If DryRun is set, Apply leaves every file untouched and instead writes a
+// unified diff of the change to w. Otherwise it rewrites the affected files
+// (or, in overlay mode, the in-memory buffers - see Overlay) and, for files
+// written to disk, records a RewriteLogEntry per renamed occurrence in a
+// rewriteLogName file next to each package, so the change can later be
+// undone with Revert.
+func (u *Unexporter) Apply(w io.Writer) error {
+	if u.toUpdate == nil {
+		return errors.New("unexport: Plan must be called before Apply")
+	}
+
+	referrers := identifierReferrers(u.global, u.toUpdate)
+
+	// A package with _test.go files is loaded as several package variants
+	// that can all list the same physical file in CompiledGoFiles, and
+	// share the renamed identifiers' *ast.Ident nodes too. Dedupe both the
+	// recorded occurrences and, below, the set of files to rewrite by
+	// absolute path, so each file is spliced exactly once.
+	var nidents int
+	occurrences := make(map[string][]rewriteOccurrence)
+	seenOffsets := make(map[string]map[int]bool)
+	for _, pkg := range u.global {
+		rename := func(id *ast.Ident, obj types.Object) {
+			if !u.toUpdate[obj] {
+				return
+			}
+			tokenFile := pkg.Fset.File(id.Pos())
+			filename, offset := tokenFile.Name(), tokenFile.Offset(id.Pos())
+			if seenOffsets[filename] == nil {
+				seenOffsets[filename] = make(map[int]bool)
+			}
+			if seenOffsets[filename][offset] {
+				return
+			}
+			seenOffsets[filename][offset] = true
+
+			nidents++
+			occurrences[filename] = append(occurrences[filename], rewriteOccurrence{
+				offset:    offset,
+				oldName:   id.Name,
+				newName:   strings.ToLower(obj.Name()),
+				referrers: referrers[canonicalKey(pkg.Fset, obj)],
+			})
+		}
+		for id, obj := range pkg.TypesInfo.Defs {
+			if obj != nil {
+				rename(id, obj)
+			}
+		}
+		for id, obj := range pkg.TypesInfo.Uses {
+			rename(id, obj)
+		}
+	}
+
+	logsByDir := make(map[string][]RewriteLogEntry)
+	var nerrs, npkgs, nfiles int
+	rewritten := make(map[string]bool)
+	for _, pkg := range u.global {
+		first := true
+		for _, filename := range pkg.CompiledGoFiles {
+			occs := occurrences[filename]
+			if len(occs) == 0 || rewritten[filename] {
+				continue
+			}
+			rewritten[filename] = true
+			if first {
+				npkgs++
+				first = false
+			}
+			nfiles++
+
+			newSrc, err := spliceIdentifiers(filename, u.Overlay, occs)
+			if err != nil {
+				fmt.Fprintln(w, err)
+				nerrs++
+				continue
+			}
+
+			if u.DryRun {
+				if err := writeDiff(w, filename, u.Overlay, newSrc); err != nil {
+					fmt.Fprintln(w, err)
+					nerrs++
+				}
+				continue
+			}
+
+			if u.Overlay != nil {
+				u.Overlay[filename] = newSrc
+				continue
+			}
+
+			if err := ioutil.WriteFile(filename, newSrc, 0644); err != nil {
+				fmt.Fprintln(w, err)
+				nerrs++
+				continue
+			}
+
+			dir := filepath.Dir(filename)
+			for _, occ := range occs {
+				logsByDir[dir] = append(logsByDir[dir], RewriteLogEntry{
+					File:                filename,
+					Offset:              occ.offset,
+					OldName:             occ.oldName,
+					NewName:             occ.newName,
+					ReferencingPackages: occ.referrers,
+				})
+			}
+		}
+	}
+
+	if !u.DryRun && u.Overlay == nil {
+		for dir, entries := range logsByDir {
+			if err := writeRewriteLog(dir, entries); err != nil {
+				fmt.Fprintln(w, err)
+				nerrs++
+			}
+		}
+	}
+
+	if nerrs > 0 {
+		return fmt.Errorf("failed to rewrite %d file%s", nerrs, plural(nerrs))
+	}
+
+	if u.DryRun {
+		return nil
+	}
+
+	if u.Overlay != nil {
+		return writeOverlayJSON(w, u.Overlay)
+	}
+
+	fmt.Fprintf(w, "Unexported %d occurrence%s in %d file%s in %d package%s.\n", nidents, plural(nidents),
+		nfiles, plural(nfiles),
+		npkgs, plural(npkgs))
+
+	return nil
+}
+
+// identifierReferrers returns, for each renamed declaration - identified by
+// canonicalKey, since a package with _test.go files type-checks the same
+// declaration once per package variant into pointer-distinct objects - the
+// sorted set of package paths among pkgs that refer to it (by definition or
+// use).
+func identifierReferrers(pkgs []*packages.Package, toUpdate map[types.Object]bool) map[string][]string {
+	sets := make(map[string]map[string]bool)
+	mark := func(pkg *packages.Package, obj types.Object) {
+		if obj == nil || !toUpdate[obj] {
+			return
+		}
+		key := canonicalKey(pkg.Fset, obj)
+		if sets[key] == nil {
+			sets[key] = make(map[string]bool)
+		}
+		sets[key][pkg.PkgPath] = true
+	}
+	for _, pkg := range pkgs {
+		for _, obj := range pkg.TypesInfo.Defs {
+			mark(pkg, obj)
+		}
+		for _, obj := range pkg.TypesInfo.Uses {
+			mark(pkg, obj)
+		}
+	}
+
+	referrers := make(map[string][]string, len(sets))
+	for key, set := range sets {
+		list := make([]string, 0, len(set))
+		for path := range set {
+			list = append(list, path)
+		}
+		sort.Strings(list)
+		referrers[key] = list
+	}
+	return referrers
+}
+
+// spliceIdentifiers returns filename's contents (read from overlay if
+// present there, otherwise from disk) with each occurrence's identifier
+// replaced in place at its recorded offset. It refuses - rather than
+// silently corrupting the file - if the bytes at an offset no longer match
+// the identifier that's supposed to be there, or if a rename would change
+// the identifier's byte length.
+func spliceIdentifiers(filename string, overlay map[string][]byte, occs []rewriteOccurrence) ([]byte, error) {
+	src, ok := overlay[filename]
+	if !ok {
+		var err error
+		src, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, len(src))
+	copy(out, src)
+	for _, occ := range occs {
+		if len(occ.newName) != len(occ.oldName) {
+			return nil, fmt.Errorf("%s: renaming %q to %q changes its byte length; refusing to rewrite in place", filename, occ.oldName, occ.newName)
+		}
+		end := occ.offset + len(occ.oldName)
+		if occ.offset < 0 || end > len(out) || string(out[occ.offset:end]) != occ.oldName {
+			return nil, fmt.Errorf("%s: identifier at offset %d no longer matches %q; refusing to rewrite", filename, occ.offset, occ.oldName)
+		}
+		copy(out[occ.offset:end], occ.newName)
+	}
+	return out, nil
+}
+
+// writeDiff prints a unified diff of filename's contents against newSrc to
+// w. The "before" contents are read from overlay if present there,
+// otherwise from disk.
+func writeDiff(w io.Writer, filename string, overlay map[string][]byte, newSrc []byte) error {
+	oldSrc, ok := overlay[filename]
+	if !ok {
+		var err error
+		oldSrc, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(oldSrc)),
+		B:        difflib.SplitLines(string(newSrc)),
+		FromFile: filename,
+		ToFile:   filename,
+		Context:  3,
+	}
+	text, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, text)
+	return err
+}
+
+// writeRewriteLog writes entries as the JSON rewrite log for dir, so that
+// Revert can later undo the rename.
+func writeRewriteLog(dir string, entries []RewriteLogEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, rewriteLogName), data, 0644)
+}
+
+// Revert undoes renames previously applied by Apply to the packages matched
+// by Patterns, using the rewrite logs Apply left next to each package. It
+// does not require Load or Plan to have been called.
+func (u *Unexporter) Revert(w io.Writer) error {
+	ctxt := u.Ctxt
+	if ctxt == nil {
+		ctxt = &build.Default
+	}
+	buildFlags := u.buildFlagsFor(ctxt)
+
+	patterns := gotool.ImportPaths(u.Patterns)
+	pkgs, err := loadPackages(patterns, buildFlags, nil)
+	if err != nil {
+		return err
+	}
+
+	dirs := make(map[string]bool)
+	for _, pkg := range pkgs {
+		for _, f := range pkg.CompiledGoFiles {
+			dirs[filepath.Dir(f)] = true
+		}
+	}
+
+	var nfiles, nerrs int
+	for dir := range dirs {
+		logPath := filepath.Join(dir, rewriteLogName)
+		data, err := ioutil.ReadFile(logPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+			nerrs++
+			continue
+		}
+
+		var entries []RewriteLogEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			fmt.Fprintln(w, err)
+			nerrs++
+			continue
+		}
+
+		byFile := make(map[string][]RewriteLogEntry)
+		for _, e := range entries {
+			byFile[e.File] = append(byFile[e.File], e)
+		}
+
+		for file, fileEntries := range byFile {
+			src, err := ioutil.ReadFile(file)
+			if err != nil {
+				fmt.Fprintln(w, err)
+				nerrs++
+				continue
+			}
+			ok := true
+			for _, e := range fileEntries {
+				if err := revertOccurrence(src, e); err != nil {
+					fmt.Fprintln(w, err)
+					nerrs++
+					ok = false
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+			if err := ioutil.WriteFile(file, src, 0644); err != nil {
+				fmt.Fprintln(w, err)
+				nerrs++
+				continue
+			}
+			nfiles++
+		}
+
+		if err := os.Remove(logPath); err != nil {
+			fmt.Fprintln(w, err)
+			nerrs++
+		}
+	}
+
+	fmt.Fprintf(w, "Reverted %d file%s.\n", nfiles, plural(nfiles))
+	if nerrs > 0 {
+		return fmt.Errorf("failed to revert %d item%s", nerrs, plural(nerrs))
+	}
+	return nil
+}
+
+// revertOccurrence undoes a single RewriteLogEntry in place in src.
+func revertOccurrence(src []byte, e RewriteLogEntry) error {
+	end := e.Offset + len(e.NewName)
+	if e.Offset < 0 || end > len(src) || string(src[e.Offset:end]) != e.NewName {
+		return fmt.Errorf("%s: rewrite log entry at offset %d no longer matches the file; refusing to revert", e.File, e.Offset)
+	}
+	copy(src[e.Offset:end], e.OldName)
+	return nil
+}
+
+func plural(n int) string {
+	if n != 1 {
+		return "s"
+	}
+	return ""
+}
+
+// overlayJSON is the {"Replace": {path: contents}} schema used by gopls and
+// goimports for editor overlays.
+type overlayJSON struct {
+	Replace map[string]string `json:"Replace"`
+}
+
+// writeOverlayJSON prints overlay to w using the overlayJSON schema.
+func writeOverlayJSON(w io.Writer, overlay map[string][]byte) error {
+	replace := make(map[string]string, len(overlay))
+	for name, contents := range overlay {
+		replace[name] = string(contents)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(overlayJSON{Replace: replace})
+}
+
+// canonicalKey identifies obj by its declaration's file and byte offset,
+// which - unlike the types.Object pointer itself - stays the same across
+// every package variant (e.g. a package and its "[pkg.test]" test variant)
+// that type-checks the same declaration.
+func canonicalKey(fset *token.FileSet, obj types.Object) string {
+	pos := fset.Position(obj.Pos())
+	return fmt.Sprintf("%s:%d", pos.Filename, pos.Offset)
+}
+
+// groupObjectsByPosition groups every object defined across global's
+// packages by canonicalKey, so the several types.Object values a single
+// declaration is type-checked into - one per package variant - can be
+// treated as equivalent.
+func groupObjectsByPosition(global []*packages.Package) map[string][]types.Object {
+	groups := make(map[string][]types.Object)
+	for _, pkg := range global {
+		for _, obj := range pkg.TypesInfo.Defs {
+			if obj == nil {
+				continue
+			}
+			key := canonicalKey(pkg.Fset, obj)
+			groups[key] = append(groups[key], obj)
+		}
+	}
+	return groups
+}
+
+// hasUse returns true if the given obj is part of the use in pkg
+func hasUse(pkg *packages.Package, obj types.Object) bool {
+	for _, o := range pkg.TypesInfo.Uses {
+		if o == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// externallyUsed scans pkgs for uses of any object in objects that cross a
+// package boundary - i.e. uses in any package other than the one that
+// defines the object - using a pool of runtime.NumCPU() workers since pkgs
+// is typically the whole reverse import closure of the packages under
+// refactor. A use from the object's own package is never reported, since Go
+// allows that regardless of export status. It returns the subset of
+// objects found to be used elsewhere.
+func externallyUsed(pkgs []*packages.Package, objects map[types.Object]bool) map[types.Object]bool {
+	jobs := make(chan *packages.Package)
+	found := make(chan types.Object)
+
+	workers := runtime.NumCPU()
+	if workers > len(pkgs) {
+		workers = len(pkgs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for pkg := range jobs {
+				for obj := range objects {
+					if pkg.PkgPath == obj.Pkg().Path() {
+						continue
+					}
+					if hasUse(pkg, obj) {
+						found <- obj
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, pkg := range pkgs {
+			jobs <- pkg
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	used := make(map[types.Object]bool)
+	for obj := range found {
+		used[obj] = true
+	}
+	return used
+}
+
+// exportedObjects returns objects which are exported only
+func exportedObjects(pkg *packages.Package) map[*ast.Ident]types.Object {
+	objects := make(map[*ast.Ident]types.Object, 0)
+	for id, obj := range pkg.TypesInfo.Defs {
+		if obj == nil {
+			continue
+		}
+
+		if obj.Exported() {
+			objects[id] = obj
+		}
+	}
+
+	return objects
+}
+
+// loadImportGraph loads the given patterns just deeply enough to discover
+// their import relationships and returns the reverse import graph: for each
+// package path, the set of package paths that directly import it.
+func loadImportGraph(patterns []string, buildFlags []string, overlay map[string][]byte) (map[string]map[string]bool, error) {
+	cfg := &packages.Config{
+		Mode:       packages.NeedName | packages.NeedImports | packages.NeedDeps,
+		BuildFlags: buildFlags,
+		Overlay:    overlay,
+	}
+
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	// With a large module graph, errors are inevitable. Report them but
+	// proceed.
+	packages.PrintErrors(pkgs)
+
+	rev := make(map[string]map[string]bool)
+	seen := make(map[string]bool)
+	var visit func(pkg *packages.Package)
+	visit = func(pkg *packages.Package) {
+		if seen[pkg.PkgPath] {
+			return
+		}
+		seen[pkg.PkgPath] = true
+		for _, imp := range pkg.Imports {
+			if rev[imp.PkgPath] == nil {
+				rev[imp.PkgPath] = make(map[string]bool)
+			}
+			rev[imp.PkgPath][pkg.PkgPath] = true
+			visit(imp)
+		}
+	}
+	for _, pkg := range pkgs {
+		visit(pkg)
+	}
+
+	return rev, nil
+}
+
+// reverseClosure returns the set of package paths that transitively import
+// path, according to rev (as built by loadImportGraph).
+func reverseClosure(rev map[string]map[string]bool, path string) map[string]bool {
+	closure := make(map[string]bool)
+	var visit func(string)
+	visit = func(p string) {
+		for importer := range rev[p] {
+			if !closure[importer] {
+				closure[importer] = true
+				visit(importer)
+			}
+		}
+	}
+	visit(path)
+	return closure
+}
+
+// loadPackages type-checks patterns and returns the resulting packages,
+// including their syntax trees and type information.
+func loadPackages(patterns []string, buildFlags []string, overlay map[string][]byte) ([]*packages.Package, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+			packages.NeedImports | packages.NeedDeps |
+			packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo,
+		BuildFlags: buildFlags,
+		Tests:      true,
+		Overlay:    overlay,
+	}
+
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	if packages.PrintErrors(pkgs) > 0 {
+		return nil, errors.New("errors while loading packages")
+	}
+
+	return pkgs, nil
+}